@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+)
+
+// syncer is implemented by WriteClosers that can flush to stable storage
+// before Close (e.g. *os.File). Backends whose writes don't need or support
+// this, such as s3Backend, simply don't implement it.
+type syncer interface {
+	Sync() error
+}
+
+// dirSyncer is implemented by backends where fsyncing the parent directory
+// after a rename is meaningful (POSIX local disks); remote backends don't
+// implement it and writeFileAtomic skips that step for them.
+type dirSyncer interface {
+	syncDir(ctx context.Context, name string) error
+}
+
+// writeFileAtomic writes data to key by first writing to a uniquely-named
+// temporary sibling, fsyncing it, and renaming it into place -- so a crash
+// mid-write always leaves either the old content or the new content at key,
+// never a truncated file that a ModTime-based diff would skip re-writing.
+func writeFileAtomic(ctx context.Context, backend Backend, key string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp-%d-%s", key, os.Getpid(), randHex())
+
+	if err := backend.MkdirAll(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+	w, err := backend.Create(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if s, ok := w.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := backend.Rename(ctx, tmp, key); err != nil {
+		return err
+	}
+	if ds, ok := backend.(dirSyncer); ok {
+		return ds.syncDir(ctx, path.Dir(key))
+	}
+	return nil
+}
+
+func randHex() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%x", binary.BigEndian.Uint64(b[:]))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Backend abstracts the storage destination that backups are written to, so
+// the chunk/manifest layer above doesn't care whether it's talking to the
+// local disk or a remote service. Every method takes a context so in-flight
+// remote calls can be cancelled when the ticker loop shuts down. Paths
+// passed to a Backend are always slash-separated and relative to whatever
+// root the Backend was constructed with.
+type Backend interface {
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+	Walk(ctx context.Context, root string, fn filepath.WalkFunc) error
+	Rename(ctx context.Context, oldName, newName string) error
+	MkdirAll(ctx context.Context, name string) error
+	Remove(ctx context.Context, name string) error
+}
+
+// newBackend picks a Backend implementation based on the URL scheme of
+// outputPath, e.g. "s3://bucket/prefix" or "sftp://user@host/path". A bare
+// filesystem path (no scheme) uses the local backend.
+func newBackend(outputPath string) (Backend, error) {
+	u, err := url.Parse(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("parsing output path: %w", err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		return &localBackend{root: outputPath}, nil
+	case "sftp":
+		return newSFTPBackend(u)
+	case "s3":
+		return newS3Backend(u)
+	case "webdav", "webdavs":
+		return newWebDAVBackend(u)
+	default:
+		return nil, fmt.Errorf("unsupported output backend scheme %q", u.Scheme)
+	}
+}
+
+// localBackend implements Backend directly on top of the local filesystem,
+// matching the behaviour FolderBackup has always had.
+type localBackend struct {
+	root string
+}
+
+func (b *localBackend) full(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *localBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(b.full(name))
+}
+
+func (b *localBackend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Create(b.full(name))
+}
+
+func (b *localBackend) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Stat(b.full(name))
+}
+
+// Walk mirrors filepath.Walk but yields paths relative to the backend root
+// (slash-separated), so callers never see the underlying root directory.
+func (b *localBackend) Walk(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return filepath.Walk(b.full(root), func(p string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(b.root, p)
+		if relErr != nil {
+			rel = p
+		}
+		return fn(filepath.ToSlash(rel), info, err)
+	})
+}
+
+func (b *localBackend) Rename(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(b.full(oldName), b.full(newName))
+}
+
+func (b *localBackend) MkdirAll(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return robustMkdirAll(b.full(name))
+}
+
+func (b *localBackend) Remove(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Remove(b.full(name))
+}
+
+// syncDir fsyncs a directory after a rename into it, so the rename itself
+// survives a crash (POSIX requires this; the fsync is best-effort on
+// platforms, like Windows, that don't support it).
+func (b *localBackend) syncDir(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d, err := os.Open(b.full(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
+
+// robustMkdirAll is a syncthing-style MkdirAll: plain os.MkdirAll can fail
+// on case-insensitive filesystems (Windows, default macOS) when a path
+// component already exists under a differently-cased name. This walks the
+// path itself and treats an "already exists as a directory" collision as
+// success instead of an error.
+func robustMkdirAll(dir string) error {
+	dir = filepath.Clean(dir)
+	if info, err := os.Stat(dir); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("%s exists and is not a directory", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := robustMkdirAll(parent); err != nil {
+			return err
+		}
+	}
+
+	err := os.Mkdir(dir, 0755)
+	if err == nil || os.IsExist(err) {
+		if info, statErr := os.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3Backend implements Backend over an S3 bucket, using the SDK's default
+// credential chain (env vars, shared config, instance role). The URL's host
+// is the bucket name and its path the key prefix, e.g. s3://bucket/prefix.
+type s3Backend struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Backend(u *url.URL) (*s3Backend, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return &s3Backend{
+		client: s3.NewFromConfig(cfg),
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+func (b *s3Backend) key(name string) string {
+	return path.Join(b.prefix, name)
+}
+
+func (b *s3Backend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	if err != nil {
+		return nil, s3NotExistErr("open", name, err)
+	}
+	return out.Body, nil
+}
+
+// s3NotExistErr translates an S3 "no such key" response into an error
+// satisfying os.IsNotExist, the same contract localBackend gets for free
+// from os.Open/os.Stat, so callers like loadRefCountStore can tell "not
+// backed up yet" from a real failure regardless of which Backend they're
+// talking to.
+func s3NotExistErr(op, name string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &noSuchKey), errors.As(err, &notFound):
+	case errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound"):
+	default:
+		return err
+	}
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// s3WriteCloser buffers writes locally and uploads the whole object on
+// Close, since S3 has no append/streaming-write primitive.
+type s3WriteCloser struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	key    string
+	buf    bytes.Buffer
+}
+
+func (w *s3WriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *s3WriteCloser) Close() error {
+	_, err := w.client.PutObject(w.ctx, &s3.PutObjectInput{
+		Bucket: aws.String(w.bucket),
+		Key:    aws.String(w.key),
+		Body:   bytes.NewReader(w.buf.Bytes()),
+	})
+	return err
+}
+
+func (b *s3Backend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return &s3WriteCloser{ctx: ctx, client: b.client, bucket: b.bucket, key: b.key(name)}, nil
+}
+
+func (b *s3Backend) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	if err != nil {
+		return nil, s3NotExistErr("stat", name, err)
+	}
+	return &s3FileInfo{name: path.Base(name), size: aws.ToInt64(out.ContentLength), modTime: aws.ToTime(out.LastModified)}, nil
+}
+
+// Walk lists one "directory level" at a time using a "/" delimiter so that
+// S3's common-key-prefixes are surfaced as synthetic directory entries
+// (IsDir() true, no object backing them) and recurses into each, rather
+// than handing back one flat, directory-less listing. listSnapshots and
+// loadSnapshotManifests both need real directory entries to tell a
+// snapshot's own folder apart from the files inside it.
+func (b *s3Backend) Walk(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	return b.walk(ctx, root, fn)
+}
+
+func (b *s3Backend) walk(ctx context.Context, dir string, fn filepath.WalkFunc) error {
+	prefix := b.key(dir)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fn(dir, nil, err)
+		}
+		for _, cp := range page.CommonPrefixes {
+			key := strings.TrimSuffix(aws.ToString(cp.Prefix), "/")
+			rel := strings.TrimPrefix(strings.TrimPrefix(key, b.prefix), "/")
+			info := &s3FileInfo{name: path.Base(rel), isDir: true}
+			err := fn(rel, info, nil)
+			if err == filepath.SkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := b.walk(ctx, rel, fn); err != nil {
+				return err
+			}
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if key == prefix {
+				continue
+			}
+			rel := strings.TrimPrefix(strings.TrimPrefix(key, b.prefix), "/")
+			info := &s3FileInfo{name: path.Base(rel), size: aws.ToInt64(obj.Size), modTime: aws.ToTime(obj.LastModified)}
+			if err := fn(rel, info, nil); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *s3Backend) Rename(ctx context.Context, oldName, newName string) error {
+	_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		CopySource: aws.String(s3CopySource(b.bucket, b.key(oldName))),
+		Key:        aws.String(b.key(newName)),
+	})
+	if err != nil {
+		return err
+	}
+	return b.Remove(ctx, oldName)
+}
+
+// s3CopySource builds a CopyObject CopySource value, which the S3 API
+// requires to be URL-encoded. bucket/key are joined and each path segment
+// is escaped on its own so a literal "/" in the key keeps separating
+// segments instead of itself being escaped -- otherwise any backed-up
+// filename with a space or a URL-significant character (+, #, %, non-ASCII)
+// fails CopyObject, or worse, gets parsed as the wrong source key.
+func s3CopySource(bucket, key string) string {
+	segments := strings.Split(path.Join(bucket, key), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// MkdirAll is a no-op: S3 has no real directories, keys are just prefixes.
+func (b *s3Backend) MkdirAll(ctx context.Context, name string) error {
+	return nil
+}
+
+func (b *s3Backend) Remove(ctx context.Context, name string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	return err
+}
+
+// s3FileInfo is a minimal os.FileInfo backed by S3 object metadata, or by a
+// common key prefix standing in for a directory that has no object of its
+// own.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i *s3FileInfo) Name() string { return i.name }
+func (i *s3FileInfo) Size() int64  { return i.size }
+func (i *s3FileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return i.isDir }
+func (i *s3FileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// webdavBackend implements Backend over WebDAV, authenticating with any
+// userinfo present on the webdav(s):// URL.
+type webdavBackend struct {
+	client *gowebdav.Client
+	root   string
+}
+
+func newWebDAVBackend(u *url.URL) (*webdavBackend, error) {
+	scheme := "https"
+	if u.Scheme == "webdav" {
+		scheme = "http"
+	}
+	endpoint := fmt.Sprintf("%s://%s", scheme, u.Host)
+
+	var user, pass string
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	client := gowebdav.NewClient(endpoint, user, pass)
+	return &webdavBackend{client: client, root: u.Path}, nil
+}
+
+func (b *webdavBackend) full(name string) string {
+	return path.Join(b.root, name)
+}
+
+func (b *webdavBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return runCancelable(ctx, func() (io.ReadCloser, error) {
+		return b.client.ReadStream(b.full(name))
+	})
+}
+
+type webdavWriteCloser struct {
+	ctx    context.Context
+	client *gowebdav.Client
+	path   string
+	buf    bytes.Buffer
+}
+
+func (w *webdavWriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *webdavWriteCloser) Close() error {
+	_, err := runCancelable(w.ctx, func() (struct{}, error) {
+		return struct{}{}, w.client.WriteStream(w.path, bytes.NewReader(w.buf.Bytes()), 0644)
+	})
+	return err
+}
+
+func (b *webdavBackend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &webdavWriteCloser{ctx: ctx, client: b.client, path: b.full(name)}, nil
+}
+
+func (b *webdavBackend) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return runCancelable(ctx, func() (os.FileInfo, error) {
+		return b.client.Stat(b.full(name))
+	})
+}
+
+func (b *webdavBackend) Walk(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	return b.walk(ctx, root, fn)
+}
+
+func (b *webdavBackend) walk(ctx context.Context, dir string, fn filepath.WalkFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	infos, err := runCancelable(ctx, func() ([]os.FileInfo, error) {
+		return b.client.ReadDir(b.full(dir))
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fn(dir, nil, err)
+		}
+		return err
+	}
+	for _, info := range infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := path.Join(dir, info.Name())
+		if err := fn(rel, info, nil); err != nil {
+			if err == filepath.SkipDir {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			if err := b.walk(ctx, rel, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *webdavBackend) Rename(ctx context.Context, oldName, newName string) error {
+	if err := b.MkdirAll(ctx, path.Dir(newName)); err != nil {
+		return err
+	}
+	_, err := runCancelable(ctx, func() (struct{}, error) {
+		return struct{}{}, b.client.Rename(b.full(oldName), b.full(newName), true)
+	})
+	return err
+}
+
+func (b *webdavBackend) MkdirAll(ctx context.Context, name string) error {
+	_, err := runCancelable(ctx, func() (struct{}, error) {
+		return struct{}{}, b.client.MkdirAll(b.full(name), 0755)
+	})
+	return err
+}
+
+func (b *webdavBackend) Remove(ctx context.Context, name string) error {
+	_, err := runCancelable(ctx, func() (struct{}, error) {
+		err := b.client.Remove(b.full(name))
+		if err != nil && strings.Contains(err.Error(), "404") {
+			err = nil
+		}
+		return struct{}{}, err
+	})
+	return err
+}
+
+// runCancelable runs fn on its own goroutine and returns as soon as
+// either fn completes or ctx is done, whichever happens first.
+// gowebdav.Client has no context-aware API, so this can't abort an
+// in-flight HTTP request -- but it unblocks the caller (e.g. the ticker
+// loop's shutdown path) instead of leaving it stuck for the request's
+// full duration.
+func runCancelable[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		val T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		ch <- result{val, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.val, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// Rolling-hash chunk boundaries, tuned for ~1 MiB average chunk size.
+const (
+	chunkWindowSize = 64
+	minChunkSize    = 256 * 1024
+	maxChunkSize    = 4 * 1024 * 1024
+	chunkMask       = (1 << 20) - 1 // low 20 bits clear -> ~1 MiB average
+)
+
+// rollingHashBase is the polynomial base used to fingerprint the sliding
+// window; rollingHashPow is base^(chunkWindowSize-1), precomputed so the
+// byte leaving the window can be subtracted in O(1).
+const rollingHashBase uint64 = 1099511628211
+
+var rollingHashPow = func() uint64 {
+	pow := uint64(1)
+	for i := 0; i < chunkWindowSize-1; i++ {
+		pow *= rollingHashBase
+	}
+	return pow
+}()
+
+// splitChunks reads r and invokes onChunk once per content-defined chunk,
+// splitting on a Rabin-style rolling hash over a 64-byte window: a boundary
+// is declared when hash&chunkMask == 0, subject to the min/max chunk size
+// bounds. The final, possibly short, chunk is always emitted.
+func splitChunks(r io.Reader, onChunk func(data []byte) error) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	var window [chunkWindowSize]byte
+	var pos, filled int
+	var hash uint64
+
+	buf := make([]byte, 0, maxChunkSize)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+
+		if filled < chunkWindowSize {
+			hash = hash*rollingHashBase + uint64(b)
+			filled++
+		} else {
+			leaving := window[pos]
+			hash = (hash-uint64(leaving)*rollingHashPow)*rollingHashBase + uint64(b)
+		}
+		window[pos] = b
+		pos = (pos + 1) % chunkWindowSize
+
+		atBoundary := filled == chunkWindowSize && hash&chunkMask == 0
+		if (atBoundary && len(buf) >= minChunkSize) || len(buf) >= maxChunkSize {
+			if err := onChunk(buf); err != nil {
+				return err
+			}
+			buf = make([]byte, 0, maxChunkSize)
+			hash, pos, filled = 0, 0, 0
+		}
+	}
+
+	if len(buf) > 0 {
+		return onChunk(buf)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSplitChunksReassemblesInput(t *testing.T) {
+	data := make([]byte, 8*maxChunkSize+maxChunkSize/3)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("generating input: %v", err)
+	}
+
+	var reassembled []byte
+	var chunkCount int
+	err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		chunkCount++
+		cp := append([]byte(nil), chunk...)
+		reassembled = append(reassembled, cp...)
+		if len(chunk) > maxChunkSize {
+			t.Errorf("chunk %d exceeds maxChunkSize: %d bytes", chunkCount, len(chunk))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("splitChunks: %v", err)
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Fatal("reassembled data does not match input")
+	}
+	if chunkCount < 2 {
+		t.Fatalf("expected input well over maxChunkSize to split into multiple chunks, got %d", chunkCount)
+	}
+}
+
+func TestSplitChunksSmallInputIsOneChunk(t *testing.T) {
+	data := []byte("a tiny file, nowhere near minChunkSize")
+
+	var chunks [][]byte
+	err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("splitChunks: %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk for small input, got %d", len(chunks))
+	}
+	if !bytes.Equal(chunks[0], data) {
+		t.Fatal("single chunk does not match input")
+	}
+}
+
+func TestSplitChunksEmptyInputYieldsNoChunks(t *testing.T) {
+	var chunks [][]byte
+	err := splitChunks(bytes.NewReader(nil), func(chunk []byte) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("splitChunks: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("expected no chunks for empty input, got %d", len(chunks))
+	}
+}
+
+func TestSplitChunksDeterministic(t *testing.T) {
+	data := make([]byte, 3*maxChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("generating input: %v", err)
+	}
+
+	boundaries := func() []int {
+		var sizes []int
+		err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+			sizes = append(sizes, len(chunk))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("splitChunks: %v", err)
+		}
+		return sizes
+	}
+
+	first := boundaries()
+	second := boundaries()
+	if len(first) != len(second) {
+		t.Fatalf("chunk count differs across runs: %d vs %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("chunk %d size differs across runs: %d vs %d", i, first[i], second[i])
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+)
+
+// chunkStore persists content-addressed chunks under chunks/<xx>/<hash> on
+// the configured output Backend, sharded by the first two hex characters of
+// the hash to keep directories small.
+type chunkStore struct {
+	backend Backend
+}
+
+func newChunkStore(backend Backend) *chunkStore {
+	return &chunkStore{backend: backend}
+}
+
+func (s *chunkStore) key(hash string) string {
+	return path.Join("chunks", hash[:2], hash)
+}
+
+func (s *chunkStore) exists(ctx context.Context, hash string) bool {
+	_, err := s.backend.Stat(ctx, s.key(hash))
+	return err == nil
+}
+
+// open returns a reader for the chunk stored under hash, for reassembling
+// a file during restore.
+func (s *chunkStore) open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	return s.backend.Open(ctx, s.key(hash))
+}
+
+// write stores data under hash, skipping the write entirely if the chunk is
+// already present (the same hash always maps to the same content).
+func (s *chunkStore) write(ctx context.Context, hash string, data []byte) error {
+	if s.exists(ctx, hash) {
+		return nil
+	}
+	return writeFileAtomic(ctx, s.backend, s.key(hash), data)
+}
+
+func (s *chunkStore) remove(ctx context.Context, hash string) error {
+	err := s.backend.Remove(ctx, s.key(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// chunkAndStore splits the local file at srcPath into content-defined
+// chunks, writes each previously-unseen chunk into store, and returns the
+// manifest describing the file as an ordered list of chunk hashes. wrap, if
+// non-nil, wraps the file reader before chunking (e.g. to apply bandwidth
+// limiting or progress reporting).
+func chunkAndStore(ctx context.Context, store *chunkStore, srcPath string, wrap func(io.Reader) io.Reader) (fileManifest, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return fileManifest{}, err
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return fileManifest{}, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if wrap != nil {
+		r = wrap(f)
+	}
+
+	m := fileManifest{Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime()}
+	err = splitChunks(r, func(data []byte) error {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if err := store.write(ctx, hash, data); err != nil {
+			return err
+		}
+		m.Chunks = append(m.Chunks, manifestChunk{Hash: hash, Size: int64(len(data))})
+		return nil
+	})
+	if err != nil {
+		return fileManifest{}, err
+	}
+	return m, nil
+}
+
+// refCountStore tracks how many manifests reference each chunk, so a chunk
+// can be deleted as soon as nothing references it anymore. It's persisted
+// as a single JSON file on the output Backend.
+type refCountStore struct {
+	backend Backend
+	key     string
+	counts  map[string]int
+}
+
+func loadRefCountStore(ctx context.Context, backend Backend) (*refCountStore, error) {
+	store := &refCountStore{backend: backend, key: "chunks/refcounts.json", counts: make(map[string]int)}
+	r, err := backend.Open(ctx, store.key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.counts); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *refCountStore) incr(hash string) {
+	s.counts[hash]++
+}
+
+// decr drops the refcount for hash and returns the count afterwards. A
+// count that reaches zero is removed from the store entirely.
+func (s *refCountStore) decr(hash string) int {
+	s.counts[hash]--
+	count := s.counts[hash]
+	if count <= 0 {
+		delete(s.counts, hash)
+		return 0
+	}
+	return count
+}
+
+func (s *refCountStore) save(ctx context.Context) error {
+	data, err := json.MarshalIndent(s.counts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctx, s.backend, s.key, data)
+}
+
+// prune drops one reference from every chunk in m and deletes from store
+// any chunk whose refcount reaches zero as a result. It replaces the old
+// moveToTrash behaviour now that files are no longer copied whole.
+func prune(ctx context.Context, store *chunkStore, refs *refCountStore, m fileManifest) error {
+	for _, c := range m.Chunks {
+		if refs.decr(c.Hash) == 0 {
+			if err := store.remove(ctx, c.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,11 +19,17 @@ type filesData struct {
 	Name     string
 	Location string
 	ModTime  time.Time
+	Size     int64
 }
 
 type pathsConfig struct {
-	InputPath  string `json:"inputPath"`
-	OutputPath string `json:"outputPath"`
+	InputPath   string          `json:"inputPath"`
+	OutputPath  string          `json:"outputPath"`
+	Retention   retentionConfig `json:"retention"`
+	MaxParallel int             `json:"maxParallel"`
+	BwLimit     int64           `json:"bwLimit"`
+	Include     []string        `json:"include"`
+	Exclude     []string        `json:"exclude"`
 }
 
 func visitFileInfos(path string, info os.FileInfo, err error) (filesData, bool) {
@@ -34,16 +44,61 @@ func visitFileInfos(path string, info os.FileInfo, err error) (filesData, bool)
 		Name:     info.Name(),
 		Location: path,
 		ModTime:  info.ModTime(),
+		Size:     info.Size(),
 	}, true
 }
 
-func gatherFiles(path string) ([]filesData, error) {
+// backupIgnoreFile is discovered while walking the input tree, the same
+// way rclone's filter layer picks up per-directory filter files: its
+// patterns are appended to the exclude rules already in effect for the
+// directory it lives in, and apply to that directory's subtree only.
+const backupIgnoreFile = ".backupignore"
+
+// gatherFiles walks the local input tree; the backup source is always a
+// local path, unlike the output which may be a remote Backend. m carries
+// the Include/Exclude patterns from pathsConfig; a directory pattern
+// match stops the walk from descending into it entirely via
+// filepath.SkipDir instead of filtering out its contents one by one.
+func gatherFiles(root string, m *matcher) ([]filesData, error) {
 	var files []filesData
-	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if filepath.Base(path) == "trash" { // ignore the trash folder when walking through the directory
-			return filepath.SkipDir
+	dirMatchers := map[string]*matcher{"": m}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Printf("Failed accessing the path %q: %v\n", p, err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+
+		if info.IsDir() {
+			dm := m
+			if rel != "" {
+				parent := dirMatchers[parentRel(rel)]
+				if parent.excluded(rel, true) {
+					return filepath.SkipDir
+				}
+				dm = parent
+			}
+			if ignore := filepath.Join(p, backupIgnoreFile); fileExists(ignore) {
+				if dm, err = dm.withIgnoreFile(rel, ignore); err != nil {
+					return err
+				}
+			}
+			dirMatchers[rel] = dm
+			return nil
+		}
+
+		if dirMatchers[parentRel(rel)].excluded(rel, false) {
+			return nil
 		}
-		fileinfo, ok := visitFileInfos(path, info, err)
+		fileinfo, ok := visitFileInfos(p, info, nil)
 		if ok {
 			files = append(files, fileinfo)
 		}
@@ -52,53 +107,118 @@ func gatherFiles(path string) ([]filesData, error) {
 	return files, err
 }
 
-func copyFile(src, dest string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.Create(dest)
-	if err != nil {
-		return err
+// parentRel returns the parent of a slash-separated path relative to the
+// backup root, or "" if rel is already a top-level entry.
+func parentRel(rel string) string {
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i]
 	}
-	defer out.Close()
-	_, err = io.Copy(out, in)
-	return err
+	return ""
 }
 
-func createIfNotExist(dir string) {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		errDir := os.MkdirAll(dir, 0755)
-		if errDir != nil {
-			log.Println("Error creating directory", errDir)
-			os.Exit(1)
-		}
-	}
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
 }
 
-func moveToTrash(src, dest string) error {
-	return os.Rename(src, dest)
+// autoExcludeOutputPath returns an exclude pattern that keeps a local
+// OutputPath nested under InputPath from being walked back in as backup
+// input on the next run -- the equivalent of the hard-coded
+// filepath.Base(path) == "trash" guard the whole-file-copy backend used
+// to have. A remote OutputPath (s3://, sftp://, webdav(s)://) or one
+// outside the input tree needs no such guard.
+func autoExcludeOutputPath(config pathsConfig) []string {
+	u, err := url.Parse(config.OutputPath)
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return nil
+	}
+	rel, err := filepath.Rel(config.InputPath, config.OutputPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil
+	}
+	return []string{"/" + filepath.ToSlash(rel) + "/"}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:]); err != nil {
+			log.Fatal("Restore failed: ", err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
 	// Create new ticker which ticks every 5 minutes
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	// Launch the process for the first time
-	process()
+	process(ctx)
 
 	for {
 		select {
 		// this case statement is run whenever the ticker ticks (every 5 minutes)
 		case <-ticker.C:
-			process()
+			process(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runRestore reassembles a snapshot back into a plain directory tree on
+// the local filesystem, the inverse of process(): "restore <destDir>"
+// restores the most recent snapshot, "restore <destDir> <snapshot>"
+// restores the named one (its directory name under "snapshots/", as
+// printed by listSnapshots).
+func runRestore(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: %s restore <destDir> [snapshot]", os.Args[0])
+	}
+	destRoot := args[0]
+
+	data, err := os.ReadFile("./path.json")
+	if err != nil {
+		return fmt.Errorf("reading path.json: %w", err)
+	}
+	var config pathsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing path.json: %w", err)
+	}
+
+	backend, err := newBackend(config.OutputPath)
+	if err != nil {
+		return fmt.Errorf("constructing output backend: %w", err)
+	}
+	store := newChunkStore(backend)
+
+	ctx := context.Background()
+	snapshotKey := ""
+	if len(args) > 1 {
+		snapshotKey = path.Join("snapshots", args[1])
+	} else {
+		snapshotKey, err = latestSnapshotDir(ctx, backend, "snapshots")
+		if err != nil {
+			return fmt.Errorf("locating latest snapshot: %w", err)
+		}
+		if snapshotKey == "" {
+			return fmt.Errorf("no snapshots found under %q", config.OutputPath)
 		}
 	}
+
+	return restoreSnapshot(ctx, backend, store, snapshotKey, destRoot)
 }
 
-func process() {
+func process(ctx context.Context) {
 	processStart := time.Now()
 	data, err := os.ReadFile("./path.json")
 	if err != nil {
@@ -109,30 +229,39 @@ func process() {
 		log.Fatal("Failed parsing path.json: ", err)
 	}
 
-	createIfNotExist(config.OutputPath)
-	trashPath := filepath.Join(config.OutputPath, "trash")
-	createIfNotExist(trashPath)
+	backend, err := newBackend(config.OutputPath)
+	if err != nil {
+		log.Fatal("Failed constructing output backend: ", err)
+	}
 
-	filesInInputPath, err := gatherFiles(config.InputPath)
+	store := newChunkStore(backend)
+	refs, err := loadRefCountStore(ctx, backend)
 	if err != nil {
-		log.Fatal("Unable to gather files from input path: ", err)
+		log.Fatal("Failed loading refcount store: ", err)
+	}
+
+	exclude := append(append([]string{}, config.Exclude...), autoExcludeOutputPath(config)...)
+	pathMatcher, err := newMatcher(config.Include, exclude)
+	if err != nil {
+		log.Fatal("Failed compiling include/exclude patterns: ", err)
 	}
-	filesInOutputPath, err := gatherFiles(config.OutputPath)
+
+	filesInInputPath, err := gatherFiles(config.InputPath, pathMatcher)
 	if err != nil {
-		log.Fatal("Unable to gather files from output path: ", err)
+		log.Fatal("Unable to gather files from input path: ", err)
 	}
 
-	inFilesMap := make(map[string]filesData)
-	outFilesMap := make(map[string]filesData)
-	for _, file := range filesInInputPath {
-		relativePath, _ := filepath.Rel(config.InputPath, file.Location)
-		inFilesMap[relativePath] = file
+	previousSnapshot, err := latestSnapshotDir(ctx, backend, "snapshots")
+	if err != nil {
+		log.Fatal("Unable to locate previous snapshot: ", err)
 	}
-	for _, file := range filesInOutputPath {
-		relativePath, _ := filepath.Rel(config.OutputPath, file.Location)
-		outFilesMap[relativePath] = file
+	previousManifests, err := loadSnapshotManifests(ctx, backend, previousSnapshot)
+	if err != nil {
+		log.Fatal("Unable to read previous snapshot: ", err)
 	}
 
+	snapshotDir := path.Join("snapshots", processStart.UTC().Format(snapshotTimeFormat))
+
 	f, err := os.OpenFile("file_error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatal("Failed opening file_error.log: ", err)
@@ -140,38 +269,19 @@ func process() {
 	defer f.Close()
 	logger := log.New(f, "", log.LstdFlags)
 
-	for _, output := range filesInOutputPath {
-		relativePath, _ := filepath.Rel(config.OutputPath, output.Location)
-		if _, exists := inFilesMap[relativePath]; !exists {
-			fileExtension := filepath.Ext(output.Name)
-			fileName := strings.TrimSuffix(output.Name, fileExtension)
-			timeStamp := "." + processStart.Format("20060102150405")
-			newName := fileName + timeStamp + fileExtension
-			newPath := filepath.Join(trashPath, newName)
-			createIfNotExist(filepath.Dir(newPath))
-			err := moveToTrash(output.Location, newPath)
-			if err != nil {
-				logger.Println("Failed moving file to trash: ", output.Name)
-			}
-		}
-	}
-
-	for _, input := range filesInInputPath {
-		relativePath, _ := filepath.Rel(config.InputPath, input.Location)
-		source := filepath.Join(config.InputPath, relativePath)
-		destination := filepath.Join(config.OutputPath, relativePath)
+	// A file missing from filesInInputPath simply isn't written into
+	// snapshotDir's manifest set; its chunks stay referenced by every
+	// older, still-retained snapshot that already counted them, so
+	// nothing is pruned here. applyRetention's prune() call below is the
+	// only place a chunk's refcount drops, and it only does so for
+	// snapshots it actually deletes.
+	runBackupPipeline(ctx, filesInInputPath, config, config.InputPath, snapshotDir, backend, store, refs, previousManifests, logger)
 
-		if output, exists := outFilesMap[relativePath]; exists {
-			// If file exists in output directory, only replace if the input file is newer
-			if output.ModTime.After(input.ModTime) {
-				continue
-			}
-		}
+	if err := applyRetention(ctx, backend, store, refs, config.Retention, "snapshots", logger); err != nil {
+		logger.Println("Failed applying retention policy: ", err)
+	}
 
-		createIfNotExist(filepath.Dir(destination))
-		err := copyFile(source, destination)
-		if err != nil {
-			logger.Println("Failed copying file: ", input.Name)
-		}
+	if err := refs.save(ctx); err != nil {
+		logger.Println("Failed saving refcount store: ", err)
 	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestChunk is one ordered entry of a fileManifest.
+type manifestChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// fileManifest records everything needed to reassemble a single backed-up
+// file from the chunk store.
+type fileManifest struct {
+	Size    int64           `json:"size"`
+	Mode    os.FileMode     `json:"mode"`
+	ModTime time.Time       `json:"modTime"`
+	Chunks  []manifestChunk `json:"chunks"`
+}
+
+func writeManifest(ctx context.Context, backend Backend, key string, m fileManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctx, backend, key, data)
+}
+
+func readManifest(ctx context.Context, backend Backend, key string) (fileManifest, error) {
+	var m fileManifest
+	r, err := backend.Open(ctx, key)
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// snapshotTimeFormat names snapshot directories after their creation time
+// in UTC, fixed-width so a lexical sort is also a time sort. RFC3339 would
+// work for Unix-only backends, but its ':' separators and zone offset are
+// illegal in an NTFS path component, breaking local-backend and
+// Windows-targeted SFTP backups; this format has no character NTFS
+// forbids.
+const snapshotTimeFormat = "20060102T150405Z"
+
+// latestSnapshotDir returns the most recent snapshot directory directly
+// under snapshotsRoot, or "" if none exist yet. Snapshot directories are
+// named after their creation time so that a lexical sort is also a time
+// sort.
+func latestSnapshotDir(ctx context.Context, backend Backend, snapshotsRoot string) (string, error) {
+	snapshots, err := listSnapshots(ctx, backend, snapshotsRoot)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	for _, key := range snapshots {
+		if key > latest {
+			latest = key
+		}
+	}
+	return latest, nil
+}
+
+// loadSnapshotManifests reads every *.manifest file under dir and returns
+// them keyed by the relative path of the file they describe.
+func loadSnapshotManifests(ctx context.Context, backend Backend, dir string) (map[string]fileManifest, error) {
+	manifests := make(map[string]fileManifest)
+	if dir == "" {
+		return manifests, nil
+	}
+	err := backend.Walk(ctx, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".manifest") {
+			return nil
+		}
+		relativePath := strings.TrimSuffix(strings.TrimPrefix(p, dir+"/"), ".manifest")
+		m, err := readManifest(ctx, backend, p)
+		if err != nil {
+			return err
+		}
+		manifests[relativePath] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rule is one compiled gitignore-style pattern: whether it negates an
+// earlier match, whether it only applies to directories, and the regexp
+// that tests a root-relative, slash-separated path.
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// matcher evaluates a backup source path against include/exclude pattern
+// lists, gitignore-style: rules are tested in order and the last one to
+// match wins, so a "!"-prefixed pattern can re-include something an
+// earlier pattern excluded.
+type matcher struct {
+	exclude []rule
+	include []rule
+}
+
+// newMatcher compiles a pathsConfig's Include and Exclude pattern lists.
+// Patterns follow .gitignore conventions: "**/*.tmp" matches at any
+// depth, "*.tmp" matches only within the directory it's declared in (or
+// anywhere under the backup root for patterns that came from config
+// rather than a .backupignore), a leading "/" anchors to the backup
+// root, and a trailing "/" matches directories only.
+func newMatcher(include, exclude []string) (*matcher, error) {
+	excludeRules, err := compileRules("", exclude)
+	if err != nil {
+		return nil, err
+	}
+	includeRules, err := compileRules("", include)
+	if err != nil {
+		return nil, err
+	}
+	return &matcher{exclude: excludeRules, include: includeRules}, nil
+}
+
+// withIgnoreFile returns a copy of m with the patterns read from a
+// .backupignore found at dir (relative to the backup root, slash
+// separated) appended to its exclude rules, so the file only affects dir
+// and the subtree beneath it. A missing file is a no-op.
+func (m *matcher) withIgnoreFile(dir, path string) (*matcher, error) {
+	patterns, err := readIgnoreFile(path)
+	if err != nil || len(patterns) == 0 {
+		return m, err
+	}
+	rules, err := compileRules(dir, patterns)
+	if err != nil {
+		return nil, err
+	}
+	next := &matcher{include: m.include}
+	next.exclude = append(append([]rule{}, m.exclude...), rules...)
+	return next, nil
+}
+
+// excluded reports whether relPath (slash-separated, relative to the
+// backup root) should be skipped from the backup: the last matching
+// exclude rule wins, unless a later include rule matches the same path
+// and reinstates it.
+func (m *matcher) excluded(relPath string, isDir bool) bool {
+	if !matchRules(m.exclude, relPath, isDir) {
+		return false
+	}
+	return !matchRules(m.include, relPath, isDir)
+}
+
+func matchRules(rules []rule, relPath string, isDir bool) bool {
+	matched := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(relPath) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+func compileRules(baseDir string, patterns []string) ([]rule, error) {
+	rules := make([]rule, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		r, err := compileRule(baseDir, p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// compileRule turns one gitignore-style pattern into a rule matching
+// root-relative paths. baseDir is the directory (relative to the backup
+// root) the pattern was declared in -- "" for patterns that came from
+// config, or a .backupignore's own directory otherwise.
+func compileRule(baseDir, pattern string) (rule, error) {
+	negate := strings.HasPrefix(pattern, "!")
+	if negate {
+		pattern = pattern[1:]
+	}
+	dirOnly := len(pattern) > 1 && strings.HasSuffix(pattern, "/")
+	if dirOnly {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.Contains(pattern, "/") {
+		// A slash anywhere but the end anchors the pattern to baseDir,
+		// same as .gitignore.
+		anchored = true
+	}
+
+	body := globToRegex(pattern)
+	if !anchored {
+		body = "(?:.*/)?" + body
+	}
+	prefix := ""
+	if baseDir != "" {
+		prefix = regexp.QuoteMeta(baseDir) + "/"
+	}
+	re, err := regexp.Compile("^" + prefix + body + "$")
+	if err != nil {
+		return rule{}, err
+	}
+	return rule{re: re, negate: negate, dirOnly: dirOnly}, nil
+}
+
+// globToRegex converts a gitignore glob into a regexp fragment: "**"
+// crosses directory boundaries, "*" and "?" don't.
+func globToRegex(pattern string) string {
+	var sb strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				i++
+				if i+1 < len(runes) && runes[i+1] == '/' {
+					sb.WriteString("(?:.*/)?")
+					i++
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '.', '+', '(', ')', '|', '^', '$', '[', ']', '{', '}', '\\':
+			sb.WriteString("\\")
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// readIgnoreFile reads a .backupignore-style file, returning one pattern
+// per non-blank, non-comment line. A missing file is not an error.
+func readIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
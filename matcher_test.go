@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatcherExcluded(t *testing.T) {
+	cases := []struct {
+		name             string
+		include, exclude []string
+		path             string
+		isDir            bool
+		want             bool
+	}{
+		{"double-star matches zero intermediate dirs", nil, []string{"a/**/b"}, "a/b", false, true},
+		{"double-star matches several intermediate dirs", nil, []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"single-star matches exactly one intermediate dir", nil, []string{"a/*/b"}, "a/x/b", false, true},
+		{"single-star doesn't match zero intermediate dirs", nil, []string{"a/*/b"}, "a/b", false, false},
+		{"single-star doesn't cross two intermediate dirs", nil, []string{"a/*/b"}, "a/x/y/b", false, false},
+		{"slash-free pattern matches at any depth", nil, []string{"*.tmp"}, "a/b/c.tmp", false, true},
+		{"negated pattern re-includes a later match", nil, []string{"*.tmp", "!important.tmp"}, "important.tmp", false, false},
+		{"leading slash anchors to the root", nil, []string{"/build"}, "sub/build", true, false},
+		{"leading slash matches a root-level entry", nil, []string{"/build"}, "build", true, true},
+		{"trailing slash doesn't match a file", nil, []string{"logs/"}, "logs", false, false},
+		{"trailing slash matches a directory", nil, []string{"logs/"}, "logs", true, true},
+		{"include list overrides a matching exclude", []string{"keep.tmp"}, []string{"*.tmp"}, "keep.tmp", false, false},
+		{"non-matching path is never excluded", nil, []string{"*.tmp"}, "keep.txt", false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := newMatcher(tc.include, tc.exclude)
+			if err != nil {
+				t.Fatalf("newMatcher: %v", err)
+			}
+			if got := m.excluded(tc.path, tc.isDir); got != tc.want {
+				t.Errorf("excluded(%q, isDir=%v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatcherWithIgnoreFileScopesToItsDirectory(t *testing.T) {
+	base, err := newMatcher(nil, nil)
+	if err != nil {
+		t.Fatalf("newMatcher: %v", err)
+	}
+	dir := t.TempDir()
+	ignorePath := filepath.Join(dir, ".backupignore")
+	if err := os.WriteFile(ignorePath, []byte("*.log\n# a comment\n\n!keep.log\n"), 0644); err != nil {
+		t.Fatalf("writing .backupignore: %v", err)
+	}
+
+	scoped, err := base.withIgnoreFile("sub", ignorePath)
+	if err != nil {
+		t.Fatalf("withIgnoreFile: %v", err)
+	}
+
+	if scoped.excluded("sub/app.log", false) != true {
+		t.Error("expected sub/app.log to be excluded by the .backupignore found in sub/")
+	}
+	if scoped.excluded("sub/keep.log", false) != false {
+		t.Error("expected sub/keep.log to be reinstated by the negated pattern")
+	}
+	if scoped.excluded("other/app.log", false) != false {
+		t.Error("expected app.log outside sub/ to be unaffected by sub/.backupignore")
+	}
+	if base.excluded("sub/app.log", false) != false {
+		t.Error("the original matcher must not be mutated by withIgnoreFile")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a simple bytes-per-second rate limiter: Wait blocks the
+// caller until n bytes' worth of tokens have accumulated. A nil bucket or a
+// non-positive rate means "unlimited".
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		now := time.Now()
+		b.tokens += int64(float64(b.rate) * now.Sub(b.last).Seconds())
+		b.last = now
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		if b.tokens >= int64(n) {
+			b.tokens -= int64(n)
+			return
+		}
+		wait := time.Duration(float64(int64(n)-b.tokens) / float64(b.rate) * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+		b.mu.Lock()
+	}
+}
+
+// progressTracker accumulates bytes copied across all workers and prints a
+// total/ETA/throughput line to stdout once a second, followed by one line
+// per file currently being copied.
+type progressTracker struct {
+	total int64
+	done  int64
+	start time.Time
+
+	mu    sync.Mutex
+	files map[string]*fileProgress
+}
+
+// fileProgress tracks a single in-flight file's progress. lastDone is only
+// ever read/written from progressTracker.run's ticker goroutine, so it
+// needs no synchronization of its own.
+type fileProgress struct {
+	size     int64
+	done     int64
+	lastDone int64
+}
+
+func newProgressTracker(total int64) *progressTracker {
+	return &progressTracker{total: total, start: time.Now(), files: make(map[string]*fileProgress)}
+}
+
+func (p *progressTracker) add(n int64) {
+	atomic.AddInt64(&p.done, n)
+}
+
+// startFile registers name as in-flight so run prints a per-file line for
+// it until finishFile is called.
+func (p *progressTracker) startFile(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files[name] = &fileProgress{size: size}
+}
+
+func (p *progressTracker) addFile(name string, n int64) {
+	p.mu.Lock()
+	fp := p.files[name]
+	p.mu.Unlock()
+	if fp != nil {
+		atomic.AddInt64(&fp.done, n)
+	}
+}
+
+func (p *progressTracker) finishFile(name string) {
+	p.mu.Lock()
+	delete(p.files, name)
+	p.mu.Unlock()
+}
+
+func (p *progressTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastDone int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			done := atomic.LoadInt64(&p.done)
+			throughput := done - lastDone
+			lastDone = done
+
+			var eta time.Duration
+			if throughput > 0 && p.total > done {
+				eta = time.Duration(float64(p.total-done)/float64(throughput)) * time.Second
+			}
+			percent := float64(100)
+			if p.total > 0 {
+				percent = float64(done) / float64(p.total) * 100
+			}
+			fmt.Printf("backup progress: %d/%d bytes (%.1f%%), %d B/s, elapsed %s, ETA %s\n",
+				done, p.total, percent, throughput, time.Since(p.start).Round(time.Second), eta.Round(time.Second))
+			p.printFiles()
+		}
+	}
+}
+
+// printFiles prints one progress line per file currently in flight, sorted
+// by name for stable output.
+func (p *progressTracker) printFiles() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.files))
+	for name := range p.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fps := make([]*fileProgress, len(names))
+	for i, name := range names {
+		fps[i] = p.files[name]
+	}
+	p.mu.Unlock()
+
+	for i, name := range names {
+		fp := fps[i]
+		done := atomic.LoadInt64(&fp.done)
+		throughput := done - fp.lastDone
+		fp.lastDone = done
+
+		var eta time.Duration
+		if throughput > 0 && fp.size > done {
+			eta = time.Duration(float64(fp.size-done)/float64(throughput)) * time.Second
+		}
+		percent := float64(100)
+		if fp.size > 0 {
+			percent = float64(done) / float64(fp.size) * 100
+		}
+		fmt.Printf("  %s: %d/%d bytes (%.1f%%), %d B/s, ETA %s\n",
+			name, done, fp.size, percent, throughput, eta.Round(time.Second))
+	}
+}
+
+// trackingReader wraps r so every byte read counts against bucket's rate
+// limit and is reported to both the run's total progress and name's
+// per-file progress.
+type trackingReader struct {
+	r        io.Reader
+	name     string
+	bucket   *tokenBucket
+	progress *progressTracker
+}
+
+func (tr *trackingReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.bucket.wait(n)
+		tr.progress.add(int64(n))
+		tr.progress.addFile(tr.name, int64(n))
+	}
+	return n, err
+}
+
+// runBackupPipeline walks the already-diffed list of input files through a
+// pool of config.MaxParallel workers (default runtime.NumCPU()), each
+// chunking and storing its file through a bandwidth-limited, progress
+// reporting reader. Unchanged files are carried forward without touching a
+// worker slot.
+func runBackupPipeline(ctx context.Context, files []filesData, config pathsConfig, inputRoot, snapshotDir string, backend Backend, store *chunkStore, refs *refCountStore, previousManifests map[string]fileManifest, logger *log.Logger) {
+	maxParallel := config.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = runtime.NumCPU()
+	}
+	bucket := newTokenBucket(config.BwLimit)
+
+	var totalBytes int64
+	for _, f := range files {
+		totalBytes += f.Size
+	}
+	progress := newProgressTracker(totalBytes)
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.run(progressCtx)
+
+	jobs := make(chan filesData)
+	var refsMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < maxParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range jobs {
+				processOneFile(ctx, input, inputRoot, snapshotDir, backend, store, refs, &refsMu, previousManifests, bucket, progress, logger)
+			}
+		}()
+	}
+
+	for _, f := range files {
+		select {
+		case jobs <- f:
+		case <-ctx.Done():
+			close(jobs)
+			wg.Wait()
+			return
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func processOneFile(ctx context.Context, input filesData, inputRoot, snapshotDir string, backend Backend, store *chunkStore, refs *refCountStore, refsMu *sync.Mutex, previousManifests map[string]fileManifest, bucket *tokenBucket, progress *progressTracker, logger *log.Logger) {
+	rel, _ := filepath.Rel(inputRoot, input.Location)
+	relativePath := filepath.ToSlash(rel)
+	manifestKey := path.Join(snapshotDir, relativePath+".manifest")
+
+	if prev, exists := previousManifests[relativePath]; exists && !input.ModTime.After(prev.ModTime) {
+		// Unchanged since the last snapshot: carry the manifest forward
+		// instead of re-chunking the file.
+		refsMu.Lock()
+		for _, c := range prev.Chunks {
+			refs.incr(c.Hash)
+		}
+		refsMu.Unlock()
+		if err := writeManifest(ctx, backend, manifestKey, prev); err != nil {
+			logger.Println("Failed writing manifest: ", input.Name)
+		}
+		progress.add(prev.Size)
+		return
+	}
+
+	progress.startFile(relativePath, input.Size)
+	defer progress.finishFile(relativePath)
+
+	m, err := chunkAndStore(ctx, store, input.Location, func(r io.Reader) io.Reader {
+		return &trackingReader{r: r, name: relativePath, bucket: bucket, progress: progress}
+	})
+	if err != nil {
+		logger.Println("Failed chunking file: ", input.Name)
+		return
+	}
+	refsMu.Lock()
+	for _, c := range m.Chunks {
+		refs.incr(c.Hash)
+	}
+	refsMu.Unlock()
+	if err := writeManifest(ctx, backend, manifestKey, m); err != nil {
+		logger.Println("Failed writing manifest: ", input.Name)
+	}
+}
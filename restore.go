@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// restoreSnapshot reconstructs every file recorded in snapshotKey (a key
+// under "snapshots/", as returned by listSnapshots/latestSnapshotDir) into
+// destRoot on the local filesystem, creating directories as needed.
+func restoreSnapshot(ctx context.Context, backend Backend, store *chunkStore, snapshotKey, destRoot string) error {
+	manifests, err := loadSnapshotManifests(ctx, backend, snapshotKey)
+	if err != nil {
+		return err
+	}
+	for relativePath, m := range manifests {
+		destPath := filepath.Join(destRoot, filepath.FromSlash(relativePath))
+		if err := restoreFile(ctx, store, m, destPath); err != nil {
+			return fmt.Errorf("restoring %s: %w", relativePath, err)
+		}
+	}
+	return nil
+}
+
+// restoreFile reassembles a single file from its manifest's chunks, in
+// order, writing it to destPath with the manifest's recorded mode and
+// modtime.
+func restoreFile(ctx context.Context, store *chunkStore, m fileManifest, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, m.Mode)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range m.Chunks {
+		if err := ctx.Err(); err != nil {
+			out.Close()
+			return err
+		}
+		r, err := store.open(ctx, c.Hash)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, r)
+		r.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(destPath, m.ModTime, m.ModTime)
+}
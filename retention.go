@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// retentionConfig mirrors restic's keep-hourly/daily/weekly/monthly model:
+// each field caps how many snapshots are kept in that bucket, counting back
+// from the most recent. A zero value disables that bucket entirely; an
+// all-zero retentionConfig disables pruning altogether.
+type retentionConfig struct {
+	Hourly  int `json:"hourly"`
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+func (r retentionConfig) enabled() bool {
+	return r.Hourly > 0 || r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0
+}
+
+// snapshotInfo pairs a snapshot's backend key with the timestamp parsed out
+// of its directory name.
+type snapshotInfo struct {
+	key  string
+	when time.Time
+}
+
+// listSnapshots returns every snapshot directly under snapshotsRoot, in no
+// particular order.
+func listSnapshots(ctx context.Context, backend Backend, snapshotsRoot string) ([]string, error) {
+	var snapshots []string
+	err := backend.Walk(ctx, snapshotsRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if p == snapshotsRoot || !info.IsDir() || path.Dir(p) != snapshotsRoot {
+			return nil
+		}
+		snapshots = append(snapshots, p)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// removeTree deletes every entry under (and including) root on backend. It
+// walks depth-first and removes in reverse order so directories are always
+// emptied before they're removed themselves.
+func removeTree(ctx context.Context, backend Backend, root string) error {
+	var paths []string
+	err := backend.Walk(ctx, root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := backend.Remove(ctx, paths[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func hourBucket(t time.Time) string  { return t.Format("2006010215") }
+func dayBucket(t time.Time) string   { return t.Format("20060102") }
+func monthBucket(t time.Time) string { return t.Format("200601") }
+func weekBucket(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// applyRetention buckets existing snapshots by hour/day/week/month, keeps
+// the newest N per bucket per retention, and deletes the rest along with
+// any chunks they exclusively referenced.
+func applyRetention(ctx context.Context, backend Backend, store *chunkStore, refs *refCountStore, retention retentionConfig, snapshotsRoot string, logger *log.Logger) error {
+	if !retention.enabled() {
+		return nil
+	}
+
+	keys, err := listSnapshots(ctx, backend, snapshotsRoot)
+	if err != nil {
+		return err
+	}
+
+	var snapshots []snapshotInfo
+	for _, key := range keys {
+		when, err := time.Parse(snapshotTimeFormat, path.Base(key))
+		if err != nil {
+			logger.Println("Skipping unparseable snapshot name: ", key)
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{key: key, when: when})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].when.After(snapshots[j].when) })
+
+	keep := make(map[string]bool)
+	buckets := []struct {
+		n     int
+		label func(time.Time) string
+	}{
+		{retention.Hourly, hourBucket},
+		{retention.Daily, dayBucket},
+		{retention.Weekly, weekBucket},
+		{retention.Monthly, monthBucket},
+	}
+	for _, b := range buckets {
+		if b.n <= 0 {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, snap := range snapshots {
+			if len(seen) >= b.n {
+				break
+			}
+			label := b.label(snap.when)
+			if seen[label] {
+				continue
+			}
+			seen[label] = true
+			keep[snap.key] = true
+		}
+	}
+
+	for _, snap := range snapshots {
+		if keep[snap.key] {
+			continue
+		}
+		manifests, err := loadSnapshotManifests(ctx, backend, snap.key)
+		if err != nil {
+			logger.Println("Failed reading snapshot for pruning: ", snap.key)
+			continue
+		}
+		for _, m := range manifests {
+			if err := prune(ctx, store, refs, m); err != nil {
+				logger.Println("Failed pruning chunks for snapshot: ", snap.key)
+			}
+		}
+		if err := removeTree(ctx, backend, snap.key); err != nil {
+			logger.Println("Failed removing snapshot: ", snap.key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBucketFunctions(t *testing.T) {
+	ref := time.Date(2026, time.March, 5, 14, 30, 0, 0, time.UTC)
+
+	if got, want := hourBucket(ref), "2026030514"; got != want {
+		t.Errorf("hourBucket = %q, want %q", got, want)
+	}
+	if got, want := dayBucket(ref), "20260305"; got != want {
+		t.Errorf("dayBucket = %q, want %q", got, want)
+	}
+	if got, want := monthBucket(ref), "202603"; got != want {
+		t.Errorf("monthBucket = %q, want %q", got, want)
+	}
+	if got, want := weekBucket(ref), "2026-W10"; got != want {
+		t.Errorf("weekBucket = %q, want %q", got, want)
+	}
+
+	sameHour := ref.Add(20 * time.Minute)
+	if hourBucket(ref) != hourBucket(sameHour) {
+		t.Error("two timestamps 20 minutes apart should share an hour bucket")
+	}
+	nextHour := ref.Add(40 * time.Minute)
+	if hourBucket(ref) == hourBucket(nextHour) {
+		t.Error("two timestamps crossing an hour boundary should not share an hour bucket")
+	}
+}
+
+// TestApplyRetentionKeepsChunksStillReferencedByRetainedSnapshots is a
+// regression test for a bug where a chunk was pruned as soon as the
+// newest snapshot stopped listing it, even though an older, still-retained
+// snapshot referenced the same chunk. It writes two snapshots sharing a
+// chunk, ages the older one out under a retention policy that keeps only
+// the newest, and asserts the shared chunk -- and the surviving snapshot's
+// manifest -- are intact afterwards.
+func TestApplyRetentionKeepsChunksStillReferencedByRetainedSnapshots(t *testing.T) {
+	ctx := context.Background()
+	backend := &localBackend{root: t.TempDir()}
+	store := newChunkStore(backend)
+	refs, err := loadRefCountStore(ctx, backend)
+	if err != nil {
+		t.Fatalf("loadRefCountStore: %v", err)
+	}
+
+	shared := writeTestChunk(t, ctx, store, "shared chunk contents")
+	olderChunk := writeTestChunk(t, ctx, store, "chunk only the older snapshot keeps")
+	newerChunk := writeTestChunk(t, ctx, store, "chunk only the newer snapshot keeps")
+
+	olderTime := time.Now().Add(-48 * time.Hour)
+	newerTime := time.Now()
+	olderSnapshot := path.Join("snapshots", olderTime.UTC().Format(snapshotTimeFormat))
+	newerSnapshot := path.Join("snapshots", newerTime.UTC().Format(snapshotTimeFormat))
+
+	olderManifest := fileManifest{Chunks: []manifestChunk{{Hash: shared}, {Hash: olderChunk}}}
+	newerManifest := fileManifest{Chunks: []manifestChunk{{Hash: shared}, {Hash: newerChunk}}}
+
+	for _, c := range olderManifest.Chunks {
+		refs.incr(c.Hash)
+	}
+	for _, c := range newerManifest.Chunks {
+		refs.incr(c.Hash)
+	}
+
+	if err := writeManifest(ctx, backend, path.Join(olderSnapshot, "file.txt.manifest"), olderManifest); err != nil {
+		t.Fatalf("writing older manifest: %v", err)
+	}
+	if err := writeManifest(ctx, backend, path.Join(newerSnapshot, "file.txt.manifest"), newerManifest); err != nil {
+		t.Fatalf("writing newer manifest: %v", err)
+	}
+
+	logger := log.New(testWriter{t}, "", 0)
+	retention := retentionConfig{Daily: 1}
+	if err := applyRetention(ctx, backend, store, refs, retention, "snapshots", logger); err != nil {
+		t.Fatalf("applyRetention: %v", err)
+	}
+
+	if _, err := backend.Stat(ctx, newerSnapshot); err != nil {
+		t.Errorf("expected newer snapshot %q to survive retention, got: %v", newerSnapshot, err)
+	}
+	if _, err := backend.Stat(ctx, olderSnapshot); err == nil {
+		t.Errorf("expected older snapshot %q to be pruned by retention", olderSnapshot)
+	}
+
+	if !store.exists(ctx, shared) {
+		t.Error("shared chunk was deleted even though the surviving snapshot still references it")
+	}
+	if !store.exists(ctx, newerChunk) {
+		t.Error("chunk exclusive to the surviving snapshot was deleted")
+	}
+	if store.exists(ctx, olderChunk) {
+		t.Error("chunk exclusive to the pruned snapshot should have been deleted")
+	}
+
+	manifests, err := loadSnapshotManifests(ctx, backend, newerSnapshot)
+	if err != nil {
+		t.Fatalf("loadSnapshotManifests: %v", err)
+	}
+	m, ok := manifests["file.txt"]
+	if !ok {
+		t.Fatal("surviving snapshot's manifest is missing")
+	}
+	if len(m.Chunks) != 2 || m.Chunks[0].Hash != shared || m.Chunks[1].Hash != newerChunk {
+		t.Errorf("surviving snapshot's manifest chunks changed: %+v", m.Chunks)
+	}
+}
+
+func writeTestChunk(t *testing.T, ctx context.Context, store *chunkStore, contents string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(contents))
+	hash := hex.EncodeToString(sum[:])
+	if err := store.write(ctx, hash, []byte(contents)); err != nil {
+		t.Fatalf("writing chunk: %v", err)
+	}
+	return hash
+}
+
+// testWriter adapts *testing.T into an io.Writer so a log.Logger used by
+// applyRetention in a test surfaces its messages via t.Log instead of stdout.
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}